@@ -0,0 +1,111 @@
+// Copyright (C) 2019 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package drpcstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zeebo/errs"
+
+	"storj.io/storj/drpc/drpcutil"
+	"storj.io/storj/drpc/drpcwire"
+)
+
+func newTestStream() *Stream {
+	return New(context.Background(), 1, new(drpcutil.Buffer), Options{})
+}
+
+func orderInterceptor(tag string, order *[]string) SendInterceptor {
+	return func(next func(drpcwire.PayloadKind, []byte) error) func(drpcwire.PayloadKind, []byte) error {
+		return func(kind drpcwire.PayloadKind, data []byte) error {
+			*order = append(*order, tag)
+			return next(kind, data)
+		}
+	}
+}
+
+func TestStream_UseOrdersInterceptors(t *testing.T) {
+	s := newTestStream()
+	defer s.Cancel()
+
+	var order []string
+	s.Use(orderInterceptor("a", &order), nil)
+	s.Use(orderInterceptor("b", &order), nil)
+
+	require.NoError(t, s.RawSend(drpcwire.PayloadKind_Message, []byte("hi")))
+	assert.Equal(t, []string{"a", "b"}, order)
+}
+
+func TestStream_SendInterceptorErrorPropagates(t *testing.T) {
+	s := newTestStream()
+	defer s.Cancel()
+
+	boom := errs.New("boom")
+	s.Use(func(next func(drpcwire.PayloadKind, []byte) error) func(drpcwire.PayloadKind, []byte) error {
+		return func(kind drpcwire.PayloadKind, data []byte) error {
+			return boom
+		}
+	}, nil)
+
+	assert.Equal(t, boom, s.RawSend(drpcwire.PayloadKind_Message, []byte("hi")))
+}
+
+func TestStream_ControlFramesBypassInterceptors(t *testing.T) {
+	s := newTestStream()
+
+	var called bool
+	s.Use(func(next func(drpcwire.PayloadKind, []byte) error) func(drpcwire.PayloadKind, []byte) error {
+		return func(kind drpcwire.PayloadKind, data []byte) error {
+			called = true
+			return next(kind, data)
+		}
+	}, nil)
+
+	require.NoError(t, s.CloseSend())
+	assert.False(t, called, "CloseSend must bypass user send interceptors")
+
+	require.NoError(t, s.Close())
+	assert.False(t, called, "Close must bypass user send interceptors")
+
+	s2 := newTestStream()
+	defer s2.Cancel()
+
+	var called2 bool
+	s2.Use(func(next func(drpcwire.PayloadKind, []byte) error) func(drpcwire.PayloadKind, []byte) error {
+		return func(kind drpcwire.PayloadKind, data []byte) error {
+			called2 = true
+			return next(kind, data)
+		}
+	}, nil)
+
+	s2.RawError(errs.New("boom"))
+	assert.False(t, called2, "RawError must bypass user send interceptors")
+}
+
+func TestStream_CompressionRoundTrips(t *testing.T) {
+	send, recv := NewCompressionInterceptors()
+
+	var wireKind drpcwire.PayloadKind
+	var wireData []byte
+	terminalSend := send(func(kind drpcwire.PayloadKind, data []byte) error {
+		wireKind, wireData = kind, data
+		return nil
+	})
+
+	payload := []byte("hello hello hello hello hello")
+	require.NoError(t, terminalSend(drpcwire.PayloadKind_Message, payload))
+	assert.NotZero(t, wireKind&drpcwire.PayloadFlag_Compressed)
+
+	terminalRecv := recv(func() (*drpcwire.Packet, error) {
+		return &drpcwire.Packet{Kind: wireKind, Data: wireData}, nil
+	})
+
+	p, err := terminalRecv()
+	require.NoError(t, err)
+	assert.Zero(t, p.Kind&drpcwire.PayloadFlag_Compressed)
+	assert.Equal(t, payload, p.Data)
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2019 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package drpcstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"storj.io/storj/drpc/drpcutil"
+	"storj.io/storj/drpc/drpcwire"
+)
+
+func TestStream_KeepaliveTimesOutOnPausedPeer(t *testing.T) {
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{})
+	defer s.Cancel()
+
+	// a paused peer never answers our pings with a pong, so the keepalive
+	// loop should fail the stream once Timeout elapses.
+	s.StartKeepalive(KeepaliveConfig{Interval: 10 * time.Millisecond, Timeout: 30 * time.Millisecond})
+
+	select {
+	case <-s.Sig().Signal():
+		assert.Error(t, s.Sig().Err())
+	case <-time.After(time.Second):
+		t.Fatal("stream did not terminate within the keepalive timeout")
+	}
+}
+
+func TestStream_KeepaliveToleratesActivity(t *testing.T) {
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{})
+	defer s.Cancel()
+
+	s.StartKeepalive(KeepaliveConfig{Interval: 10 * time.Millisecond, Timeout: 200 * time.Millisecond})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				s.touchActivity()
+			}
+		}
+	}()
+
+	select {
+	case <-s.Sig().Signal():
+		t.Fatalf("stream unexpectedly terminated: %v", s.Sig().Err())
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestStream_SendPingRejectedAfterTermination(t *testing.T) {
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{})
+	require.NoError(t, s.Close())
+
+	_, err := s.sendPing()
+	assert.Error(t, err, "sendPing must not write to the wire once the stream has terminated")
+}
+
+func TestStream_HandlePingRejectedAfterTermination(t *testing.T) {
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{})
+	require.NoError(t, s.Close())
+
+	err := s.handlePing(&drpcwire.Packet{Kind: drpcwire.PayloadKind_Ping, Data: make([]byte, 8)})
+	assert.Error(t, err, "handlePing must not reply once the stream has terminated")
+}
+
+func TestStream_CloseRacesKeepalive(t *testing.T) {
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{})
+	s.StartKeepalive(KeepaliveConfig{Interval: time.Millisecond, Timeout: time.Second})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return while racing a pending keepalive tick")
+	}
+
+	// give the keepalive goroutine a chance to fire its pending tick; with
+	// pollSend gating sendPing, it must observe termSig and bail out
+	// instead of writing a Ping frame after the terminal frame went out.
+	time.Sleep(20 * time.Millisecond)
+}
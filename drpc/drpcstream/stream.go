@@ -5,9 +5,12 @@ package drpcstream
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"storj.io/storj/drpc"
@@ -15,6 +18,39 @@ import (
 	"storj.io/storj/drpc/drpcwire"
 )
 
+// defaultInitialWindow is the flow control credit granted to the peer (and
+// expected from the peer) when a Stream is constructed with a zero-value
+// Options.
+const defaultInitialWindow = 64 * 1024
+
+// defaultQueueSize is the depth of the incoming packet queue used when a
+// Stream is constructed with a zero-value Options.
+const defaultQueueSize = 100
+
+// Options controls the tunable behavior of a Stream.
+type Options struct {
+	// InitialWindow is the number of bytes of flow control credit each side
+	// of the stream grants the other up front, and replenishes as data is
+	// consumed. If zero, defaultInitialWindow is used.
+	InitialWindow int64
+
+	// QueueSize overrides the depth of the incoming packet queue. If zero,
+	// defaultQueueSize is used.
+	QueueSize int
+}
+
+// KeepaliveConfig configures periodic pings used to detect a silently dead
+// peer on an otherwise idle Stream.
+type KeepaliveConfig struct {
+	// Interval is how long the stream waits without send or receive
+	// activity before sending a ping. A zero Interval disables keepalives.
+	Interval time.Duration
+
+	// Timeout is how long the stream waits for a matching pong before
+	// considering the peer dead and failing the stream.
+	Timeout time.Duration
+}
+
 type Stream struct {
 	messageID uint64
 	ctx       context.Context
@@ -27,10 +63,106 @@ type Stream struct {
 	termSig   *drpcutil.Signal
 	queue     chan *drpcwire.Packet
 	sendMu    sync.Mutex
+
+	// windowSize is the configured InitialWindow, used to size the
+	// WindowUpdate coalescing threshold on the receive side.
+	windowSize int64
+
+	// sendWindow is the remaining flow control credit this side may spend
+	// on outgoing message payloads before RawSend must block. It is only
+	// ever mutated while holding sendWindowMu.
+	sendWindowMu sync.Mutex
+	sendWindow   int64
+	sendWindowCh chan struct{}
+
+	// recvUnacked is the number of message payload bytes delivered to the
+	// caller since the last WindowUpdate we sent the peer.
+	recvMu      sync.Mutex
+	recvUnacked int64
+
+	// lastActivity is the unix nanosecond timestamp of the last successful
+	// RawSend or RawRecv, used by the keepalive loop to find idle periods.
+	lastActivity int64
+
+	// pongs delivers nonces from received Pong packets to a keepalive loop
+	// waiting on sendPing's response.
+	pongs chan [8]byte
+
+	// interceptorMu guards sendInterceptors and recvInterceptors so Use can
+	// be called concurrently with sends and receives.
+	interceptorMu    sync.RWMutex
+	sendInterceptors []SendInterceptor
+	recvInterceptors []RecvInterceptor
+}
+
+// SendInterceptor wraps the function that sends a single message's payload,
+// letting callers layer cross-cutting behavior - metrics, tracing,
+// compression, encryption, per-message auth - around RawSend without
+// forking the stream.
+type SendInterceptor func(next func(kind drpcwire.PayloadKind, data []byte) error) func(kind drpcwire.PayloadKind, data []byte) error
+
+// RecvInterceptor is the symmetric counterpart of SendInterceptor, wrapping
+// the function that receives a single packet around RawRecv.
+type RecvInterceptor func(next func() (*drpcwire.Packet, error)) func() (*drpcwire.Packet, error)
+
+// Use registers a SendInterceptor/RecvInterceptor pair. Interceptors compose
+// in registration order: the first one registered is outermost, observing
+// and able to short-circuit a call before any interceptor registered after
+// it. Either argument may be nil to register only one side. Control frames
+// sent by RawError, RawCancel, CloseSend, and Close bypass user interceptors
+// entirely, since they write to the wire directly instead of going through
+// RawSend.
+func (s *Stream) Use(send SendInterceptor, recv RecvInterceptor) {
+	s.interceptorMu.Lock()
+	defer s.interceptorMu.Unlock()
+	if send != nil {
+		s.sendInterceptors = append(s.sendInterceptors, send)
+	}
+	if recv != nil {
+		s.recvInterceptors = append(s.recvInterceptors, recv)
+	}
+}
+
+// composedSend builds the current chain of sendInterceptors around
+// rawSendDirect, with the first registered interceptor outermost.
+func (s *Stream) composedSend() func(drpcwire.PayloadKind, []byte) error {
+	s.interceptorMu.RLock()
+	interceptors := s.sendInterceptors
+	s.interceptorMu.RUnlock()
+
+	send := s.rawSendDirect
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		send = interceptors[i](send)
+	}
+	return send
 }
 
-func New(ctx context.Context, streamID uint64, buf *drpcutil.Buffer) *Stream {
+// composedRecv builds the current chain of recvInterceptors around
+// rawRecvDirect, with the first registered interceptor outermost.
+func (s *Stream) composedRecv() func() (*drpcwire.Packet, error) {
+	s.interceptorMu.RLock()
+	interceptors := s.recvInterceptors
+	s.interceptorMu.RUnlock()
+
+	recv := s.rawRecvDirect
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		recv = interceptors[i](recv)
+	}
+	return recv
+}
+
+func New(ctx context.Context, streamID uint64, buf *drpcutil.Buffer, opts Options) *Stream {
 	ctx, cancel := context.WithCancel(ctx)
+
+	window := opts.InitialWindow
+	if window <= 0 {
+		window = defaultInitialWindow
+	}
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
 	s := &Stream{
 		ctx:      ctx,
 		cancel:   cancel,
@@ -40,26 +172,43 @@ func New(ctx context.Context, streamID uint64, buf *drpcutil.Buffer) *Stream {
 		sendSig:  drpcutil.NewSignal(),
 		recvSig:  drpcutil.NewSignal(),
 		termSig:  drpcutil.NewSignal(),
-		queue:    make(chan *drpcwire.Packet, 100),
+		queue:    make(chan *drpcwire.Packet, queueSize),
+
+		windowSize:   window,
+		sendWindow:   window,
+		sendWindowCh: make(chan struct{}),
+
+		lastActivity: time.Now().UnixNano(),
+		pongs:        make(chan [8]byte, 1),
 	}
 	go s.monitor()
 	return s
 }
 
+// StartKeepalive begins sending periodic pings after Interval of send and
+// receive inactivity, failing the stream if no matching pong arrives within
+// Timeout.
+// It is a no-op if cfg.Interval is zero.
+func (s *Stream) StartKeepalive(cfg KeepaliveConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	go s.keepalive(cfg)
+}
+
 var _ drpc.Stream = (*Stream)(nil)
 
 //
 // exported accessors
 //
 
-func (s *Stream) Cancel()                      { s.cancel() }
-func (s *Stream) Context() context.Context     { return s.ctx }
-func (s *Stream) StreamID() uint64             { return s.streamID }
-func (s *Stream) Sig() *drpcutil.Signal        { return s.sig }
-func (s *Stream) SendSig() *drpcutil.Signal    { return s.sendSig }
-func (s *Stream) RecvSig() *drpcutil.Signal    { return s.recvSig }
-func (s *Stream) TermSig() *drpcutil.Signal    { return s.termSig }
-func (s *Stream) Queue() chan *drpcwire.Packet { return s.queue }
+func (s *Stream) Cancel()                   { s.cancel() }
+func (s *Stream) Context() context.Context  { return s.ctx }
+func (s *Stream) StreamID() uint64          { return s.streamID }
+func (s *Stream) Sig() *drpcutil.Signal     { return s.sig }
+func (s *Stream) SendSig() *drpcutil.Signal { return s.sendSig }
+func (s *Stream) RecvSig() *drpcutil.Signal { return s.recvSig }
+func (s *Stream) TermSig() *drpcutil.Signal { return s.termSig }
 
 //
 // basic helpers
@@ -101,12 +250,244 @@ func (s *Stream) wireSendFlush(kind drpcwire.PayloadKind, data []byte) error {
 	return s.buf.Flush()
 }
 
+//
+// flow control
+//
+
+// acquireSendWindow blocks until n bytes of send credit are available,
+// consuming them, or returns an error if the stream is canceled or
+// terminated first.
+func (s *Stream) acquireSendWindow(n int64) error {
+	for {
+		s.sendWindowMu.Lock()
+		if s.sendWindow >= n {
+			s.sendWindow -= n
+			s.sendWindowMu.Unlock()
+			return nil
+		}
+		ch := s.sendWindowCh
+		s.sendWindowMu.Unlock()
+
+		select {
+		case <-ch:
+		case <-s.sig.Signal():
+			return s.sig.Err()
+		case <-s.termSig.Signal():
+			return s.termSig.Err()
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// grantSendWindow adds delta bytes of send credit and wakes any sender
+// blocked in acquireSendWindow.
+func (s *Stream) grantSendWindow(delta int64) {
+	s.sendWindowMu.Lock()
+	s.sendWindow += delta
+	ch := s.sendWindowCh
+	s.sendWindowCh = make(chan struct{})
+	s.sendWindowMu.Unlock()
+	close(ch)
+}
+
+// sendWindowUpdate emits a WindowUpdate control frame granting the peer
+// delta additional bytes of send credit. It bypasses flow control itself,
+// the same as the other control frames sent by RawError/RawCancel/Close.
+func (s *Stream) sendWindowUpdate(delta int64) error {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], uint32(delta))
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if err, sendClosed := s.pollSend(); err != nil && !sendClosed {
+		return err
+	}
+	return s.wireSendFlush(drpcwire.PayloadKind_WindowUpdate, data[:])
+}
+
+// isMessageKind reports whether kind is a Message payload once any flag
+// bits (e.g. PayloadFlag_Compressed, set by interceptors such as the ones
+// NewCompressionInterceptors returns) are masked out. Flow control keys
+// off this, so a straight equality check against PayloadKind_Message would
+// silently stop applying to every flagged message.
+func isMessageKind(kind drpcwire.PayloadKind) bool {
+	return kind&^drpcwire.PayloadFlag_Compressed == drpcwire.PayloadKind_Message
+}
+
+// accountRecv updates the receive-side flow control bookkeeping for a
+// delivered message packet, sending the peer a WindowUpdate once at least
+// half of the configured window has been consumed without acknowledgement.
+func (s *Stream) accountRecv(p *drpcwire.Packet) {
+	if !isMessageKind(p.Kind) || len(p.Data) == 0 {
+		return
+	}
+
+	threshold := s.windowSize / 2
+	if threshold <= 0 {
+		threshold = 1
+	}
+
+	s.recvMu.Lock()
+	s.recvUnacked += int64(len(p.Data))
+	delta := int64(0)
+	if s.recvUnacked >= threshold {
+		delta, s.recvUnacked = s.recvUnacked, 0
+	}
+	s.recvMu.Unlock()
+
+	if delta > 0 {
+		_ = s.sendWindowUpdate(delta)
+	}
+}
+
+//
+// keepalive
+//
+
+// keepalive runs until the stream terminates, sending a ping whenever the
+// stream has seen no send or receive for cfg.Interval and failing the stream if
+// the peer doesn't pong back within cfg.Timeout.
+func (s *Stream) keepalive(cfg KeepaliveConfig) {
+	timer := time.NewTimer(cfg.Interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.sig.Signal():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if idle := time.Since(s.lastActivityTime()); idle < cfg.Interval {
+			timer.Reset(cfg.Interval - idle)
+			continue
+		}
+
+		nonce, err := s.sendPing()
+		if err != nil {
+			s.sig.Set(err)
+			return
+		}
+
+		select {
+		case got := <-s.pongs:
+			if got != nonce {
+				// a pong for an older ping; the peer is still alive, so
+				// just wait for the next interval to try again.
+			}
+			timer.Reset(cfg.Interval)
+		case <-time.After(cfg.Timeout):
+			s.sig.Set(drpc.Error.New("keepalive timeout: no pong received"))
+			return
+		case <-s.sig.Signal():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// lastActivityTime returns the time of the last successful RawSend or
+// RawRecv.
+func (s *Stream) lastActivityTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActivity))
+}
+
+// touchActivity records that a send or receive just happened.
+func (s *Stream) touchActivity() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// sendPing writes a Ping control frame carrying a fresh random nonce. It
+// does not consume flow-control credit and does not advance messageID,
+// since it uses a fixed PacketID rather than nextPid. Like every other
+// writer in this file, it refuses to write once the stream has started
+// terminating, so a ping in flight when Close/RawCancel/RawError fires
+// can't land on the wire after the terminal frame.
+func (s *Stream) sendPing() ([8]byte, error) {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nonce, err
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if err, sendClosed := s.pollSend(); err != nil && !sendClosed {
+		return nonce, err
+	}
+
+	pid := drpcwire.PacketID{StreamID: s.streamID}
+	if err := drpcwire.Split(drpcwire.PayloadKind_Ping, pid, nonce[:], s.buf.Write); err != nil {
+		return nonce, err
+	}
+	return nonce, s.buf.Flush()
+}
+
+// handlePing replies to a received Ping with a Pong carrying the same
+// nonce. Like sendPing, it bypasses flow control and messageID, and
+// refuses to write once the stream has started terminating.
+func (s *Stream) handlePing(p *drpcwire.Packet) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if err, sendClosed := s.pollSend(); err != nil && !sendClosed {
+		return err
+	}
+
+	pid := drpcwire.PacketID{StreamID: s.streamID}
+	if err := drpcwire.Split(drpcwire.PayloadKind_Pong, pid, p.Data, s.buf.Write); err != nil {
+		return err
+	}
+	return s.buf.Flush()
+}
+
+// handlePong delivers a received Pong's nonce to a keepalive loop waiting
+// in sendPing's caller. The pongs channel holds one nonce; a pong that
+// arrives while that slot is already full is dropped.
+func (s *Stream) handlePong(p *drpcwire.Packet) {
+	if len(p.Data) != 8 {
+		return
+	}
+	var nonce [8]byte
+	copy(nonce[:], p.Data)
+	select {
+	case s.pongs <- nonce:
+	default:
+	}
+}
+
 //
 // raw send/recv/close primitives
 //
 
+// RawSend sends a single kind/data payload through any registered
+// SendInterceptors before writing it to the wire.
 func (s *Stream) RawSend(kind drpcwire.PayloadKind, data []byte) error {
+	return s.composedSend()(kind, data)
+}
+
+// rawSendDirect is the terminal step of the send interceptor chain: it
+// applies flow control and writes the payload to the wire. A single
+// drpcwire.Split call fragments the payload into physical wire frames
+// under one PacketID, the same as every other kind sent through here;
+// for a message payload, credit is acquired per frame as Split produces
+// it rather than for the whole payload up front, so a message larger
+// than the window doesn't have to reserve credit it can never get before
+// any of its bytes reach the peer.
+func (s *Stream) rawSendDirect(kind drpcwire.PayloadKind, data []byte) error {
+	message := isMessageKind(kind)
+
 	err := drpcwire.Split(kind, s.nextPid(), data, func(pkt drpcwire.Packet) error {
+		if message {
+			if err := s.acquireSendWindow(int64(len(pkt.Data))); err != nil {
+				return err
+			}
+		}
+
 		s.sendMu.Lock()
 		defer s.sendMu.Unlock()
 		if err, _ := s.pollSend(); err != nil {
@@ -118,6 +499,7 @@ func (s *Stream) RawSend(kind drpcwire.PayloadKind, data []byte) error {
 		s.sig.Set(err)
 		return err
 	}
+	s.touchActivity()
 	return nil
 }
 
@@ -134,7 +516,14 @@ func (s *Stream) RawFlush() error {
 	return nil
 }
 
+// RawRecv receives a single packet through any registered RecvInterceptors.
 func (s *Stream) RawRecv() (*drpcwire.Packet, error) {
+	return s.composedRecv()()
+}
+
+// rawRecvDirect is the terminal step of the receive interceptor chain: it
+// reads the next packet off the queue and accounts for flow control.
+func (s *Stream) rawRecvDirect() (*drpcwire.Packet, error) {
 	if err, ok := s.sig.Get(); ok {
 		return nil, err
 	}
@@ -145,10 +534,42 @@ func (s *Stream) RawRecv() (*drpcwire.Packet, error) {
 		if !ok {
 			return nil, io.EOF
 		}
+		s.touchActivity()
+		s.accountRecv(p)
 		return p, nil
 	}
 }
 
+// HandlePacket is the only entry point the connection's receive loop should
+// use to deliver packets addressed to this stream; the incoming queue
+// itself is unexported so nothing can bypass it. WindowUpdate, Ping, and
+// Pong packets are handled here transparently; everything else is
+// forwarded to the queue that RawRecv/MsgRecv read from.
+func (s *Stream) HandlePacket(p *drpcwire.Packet) error {
+	switch p.Kind {
+	case drpcwire.PayloadKind_WindowUpdate:
+		if len(p.Data) < 4 {
+			return drpc.Error.New("invalid window update payload")
+		}
+		s.grantSendWindow(int64(binary.BigEndian.Uint32(p.Data)))
+		return nil
+	case drpcwire.PayloadKind_Ping:
+		return s.handlePing(p)
+	case drpcwire.PayloadKind_Pong:
+		s.handlePong(p)
+		return nil
+	default:
+		select {
+		case s.queue <- p:
+			return nil
+		case <-s.sig.Signal():
+			return s.sig.Err()
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
 func (s *Stream) RawError(err error) {
 	s.sendMu.Lock()
 	defer s.sendMu.Unlock()
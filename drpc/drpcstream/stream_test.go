@@ -0,0 +1,140 @@
+// Copyright (C) 2019 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package drpcstream
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"storj.io/storj/drpc/drpcutil"
+	"storj.io/storj/drpc/drpcwire"
+)
+
+func TestStream_FlowControlBlocksUntilDrained(t *testing.T) {
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{InitialWindow: 16})
+	defer s.Cancel()
+
+	// the payload is ten windows' worth of data, so RawSend must acquire
+	// credit for it incrementally, as drpcwire.Split produces wire frames,
+	// rather than reserving all of it up front.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.RawSend(drpcwire.PayloadKind_Message, make([]byte, 10*16))
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("send should have blocked until the window was drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the consumer grants back a window's worth of credit at a time, as if
+	// acking received data, until the sender has enough to proceed.
+	for i := 0; i < 10; i++ {
+		s.grantSendWindow(16)
+	}
+
+	select {
+	case err := <-sent:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("send never unblocked after the window was replenished")
+	}
+}
+
+func TestStream_LargeMessageUsesSinglePacketID(t *testing.T) {
+	// a message far larger than the window must still be exactly one
+	// logical send: a single drpcwire.Split call fragments it into wire
+	// frames under one PacketID. Calling Split once per window-sized
+	// piece instead would hand out a fresh PacketID per piece and the
+	// receive side has no way to reassemble those back into one message.
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{InitialWindow: 16})
+	defer s.Cancel()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.RawSend(drpcwire.PayloadKind_Message, make([]byte, 10*16))
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		s.grantSendWindow(16)
+	}
+
+	select {
+	case err := <-sent:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("send never completed after the window was replenished")
+	}
+
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&s.messageID))
+}
+
+func TestStream_FlowControlAppliesToFlaggedMessageKinds(t *testing.T) {
+	// a PayloadKind_Message with extra flag bits set (as NewCompressionInterceptors
+	// produces) must still be gated by flow control, not silently skip it.
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{InitialWindow: 16})
+	defer s.Cancel()
+
+	flagged := drpcwire.PayloadKind_Message | drpcwire.PayloadFlag_Compressed
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.RawSend(flagged, make([]byte, 10*16))
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("flagged message send should have blocked until the window was drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 10; i++ {
+		s.grantSendWindow(16)
+	}
+
+	select {
+	case err := <-sent:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("flagged message send never unblocked after the window was replenished")
+	}
+}
+
+func TestStream_AccountRecvCreditsFlaggedMessageKinds(t *testing.T) {
+	// the window is large enough that 8 bytes stay below the window/2
+	// WindowUpdate threshold, so they remain counted in recvUnacked.
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{InitialWindow: 64})
+	defer s.Cancel()
+
+	flagged := drpcwire.PayloadKind_Message | drpcwire.PayloadFlag_Compressed
+	s.accountRecv(&drpcwire.Packet{Kind: flagged, Data: make([]byte, 8)})
+
+	assert.Equal(t, int64(8), s.recvUnacked, "a flagged message packet must still be accounted for")
+}
+
+func TestStream_CancelUnblocksWaitingSender(t *testing.T) {
+	s := New(context.Background(), 1, new(drpcutil.Buffer), Options{InitialWindow: 16})
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.RawSend(drpcwire.PayloadKind_Message, make([]byte, 10*16))
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	s.Cancel()
+
+	select {
+	case err := <-sent:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("cancel did not unblock the waiting sender")
+	}
+}
@@ -4,6 +4,11 @@
 package encryption
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
 	"github.com/zeebo/errs"
 	"storj.io/storj/pkg/paths"
 	"storj.io/storj/pkg/storj"
@@ -188,4 +193,259 @@ func (n *node) lookup(path paths.Iterator, bestConsumed string, bestBase *Base,
 
 	// Recurse to the next node in the tree.
 	return child.lookup(path, bestConsumed, bestBase, unenc)
-}
\ No newline at end of file
+}
+
+// Iterate walks over the Store calling fn with every Base it contains, in order
+// sorted first by bucket name and then by unencrypted path. If fn returns an
+// error, iteration halts and that error is returned.
+func (s *Store) Iterate(fn func(bucket string, base *Base) error) error {
+	buckets := make([]string, 0, len(s.roots))
+	for bucket := range s.roots {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+
+	for _, bucket := range buckets {
+		if err := s.roots[bucket].iterate(bucket, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iterate calls fn with the node's own Base, if any, and then recurses into
+// its children in sorted order of their unencrypted path component.
+func (n *node) iterate(bucket string, fn func(bucket string, base *Base) error) error {
+	if n.base != nil {
+		if err := fn(bucket, n.base); err != nil {
+			return err
+		}
+	}
+
+	parts := make([]string, 0, len(n.unenc))
+	for part := range n.unenc {
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+
+	for _, part := range parts {
+		if err := n.unenc[part].iterate(bucket, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the subtree rooted at the unencrypted path in the bucket,
+// then prunes any ancestor nodes that are left with no base and no children.
+func (s *Store) Remove(bucket string, unenc paths.Unencrypted) error {
+	root, ok := s.roots[bucket]
+	if !ok {
+		return nil
+	}
+
+	if empty, err := root.remove(unenc.Iterator()); err != nil {
+		return err
+	} else if empty {
+		delete(s.roots, bucket)
+	}
+	return nil
+}
+
+// remove deletes the part of the tree found by walking unenc, reporting
+// whether the node is left empty so that the caller can prune it.
+func (n *node) remove(unenc paths.Iterator) (bool, error) {
+	if unenc.Done() {
+		n.base = nil
+		n.unenc = make(map[string]*node)
+		n.unencMap = make(map[string]string)
+		n.enc = make(map[string]*node)
+		n.encMap = make(map[string]string)
+		return true, nil
+	}
+
+	unencPart := unenc.Next()
+	child, ok := n.unenc[unencPart]
+	if !ok {
+		return n.empty(), nil
+	}
+
+	empty, err := child.remove(unenc)
+	if err != nil {
+		return false, err
+	}
+	if empty {
+		encPart := n.unencMap[unencPart]
+		delete(n.unenc, unencPart)
+		delete(n.unencMap, unencPart)
+		delete(n.enc, encPart)
+		delete(n.encMap, encPart)
+	}
+
+	return n.empty(), nil
+}
+
+// empty reports if the node has neither a base nor any children, meaning it
+// is safe to prune from its parent.
+func (n *node) empty() bool {
+	return n.base == nil && len(n.unenc) == 0
+}
+
+// MarshalBinary serializes the Store so that it can be cached and later
+// restored with UnmarshalBinary, letting callers reuse a derived-key
+// hierarchy across process restarts instead of rederiving it from scratch.
+//
+// The format is a big-endian uint32 count of buckets followed by, for each
+// bucket, a length-prefixed name, a uint32 count of entries, and then that
+// many <unencrypted path, encrypted path, key> triples.
+func (s *Store) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+
+	type bucketBases struct {
+		bucket string
+		bases  []*Base
+	}
+
+	var grouped []*bucketBases
+	index := make(map[string]*bucketBases)
+
+	err := s.Iterate(func(bucket string, base *Base) error {
+		bb, ok := index[bucket]
+		if !ok {
+			bb = &bucketBases{bucket: bucket}
+			index[bucket] = bb
+			grouped = append(grouped, bb)
+		}
+		bb.bases = append(bb.bases, base)
+		return nil
+	})
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	if err := writeUint32(&buf, uint32(len(grouped))); err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	for _, bb := range grouped {
+		if err := writeString(&buf, bb.bucket); err != nil {
+			return nil, errs.Wrap(err)
+		}
+		if err := writeUint32(&buf, uint32(len(bb.bases))); err != nil {
+			return nil, errs.Wrap(err)
+		}
+		for _, base := range bb.bases {
+			if err := writeString(&buf, base.Unencrypted.Raw()); err != nil {
+				return nil, errs.Wrap(err)
+			}
+			if err := writeString(&buf, base.Encrypted.Raw()); err != nil {
+				return nil, errs.Wrap(err)
+			}
+			if _, err := buf.Write(base.Key[:]); err != nil {
+				return nil, errs.Wrap(err)
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores a Store previously serialized with MarshalBinary,
+// replacing any mappings currently held by the Store.
+func (s *Store) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+
+	nbuckets, err := readUint32(r)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	roots := make(map[string]*node, nbuckets)
+
+	for i := uint32(0); i < nbuckets; i++ {
+		bucket, err := readString(r)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+
+		nentries, err := readUint32(r)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+
+		root, ok := roots[bucket]
+		if !ok {
+			root = newNode()
+			roots[bucket] = root
+		}
+
+		for j := uint32(0); j < nentries; j++ {
+			unencRaw, err := readString(r)
+			if err != nil {
+				return errs.Wrap(err)
+			}
+			encRaw, err := readString(r)
+			if err != nil {
+				return errs.Wrap(err)
+			}
+
+			var key storj.Key
+			if _, err := io.ReadFull(r, key[:]); err != nil {
+				return errs.Wrap(err)
+			}
+
+			unenc := paths.NewUnencrypted(unencRaw)
+			enc := paths.NewEncrypted(encRaw)
+
+			if err := root.add(unenc.Iterator(), enc.Iterator(), &Base{
+				Unencrypted: unenc,
+				Encrypted:   enc,
+				Key:         key,
+			}); err != nil {
+				return errs.Wrap(err)
+			}
+		}
+	}
+
+	s.roots = roots
+	return nil
+}
+
+// writeUint32 writes v to w in big-endian form.
+func writeUint32(w io.Writer, v uint32) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// readUint32 reads a big-endian uint32 from r.
+func readUint32(r io.Reader) (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+// writeString writes a length-prefixed string to w.
+func writeString(w io.Writer, s string) error {
+	if err := writeUint32(w, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// readString reads a length-prefixed string from r.
+func readString(r io.Reader) (string, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2019 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package encryption
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"storj.io/storj/pkg/paths"
+	"storj.io/storj/pkg/storj"
+)
+
+func addEntry(t *testing.T, store *Store, bucket, unenc, enc string, key byte) {
+	t.Helper()
+	var storjKey storj.Key
+	storjKey[0] = key
+
+	err := store.Add(bucket, paths.NewUnencrypted(unenc), paths.NewEncrypted(enc), storjKey)
+	require.NoError(t, err)
+}
+
+func newTestStore(t *testing.T) *Store {
+	store := NewStore()
+	addEntry(t, store, "b1", "u1/u2/u3", "e1/e2/e3", 3)
+	addEntry(t, store, "b1", "u1/u2/u3/u4", "e1/e2/e3/e4", 4)
+	addEntry(t, store, "b1", "u1/u5", "e1/e5", 5)
+	addEntry(t, store, "b1", "u6", "e6", 6)
+	addEntry(t, store, "b1", "u6/u7/u8", "e6/e7/e8", 8)
+	addEntry(t, store, "b2", "u1", "e1p", 1)
+	return store
+}
+
+func TestStore_Iterate(t *testing.T) {
+	store := newTestStore(t)
+
+	var got []string
+	err := store.Iterate(func(bucket string, base *Base) error {
+		got = append(got, bucket+":"+base.Unencrypted.Raw())
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"b1:u1/u2/u3",
+		"b1:u1/u2/u3/u4",
+		"b1:u1/u5",
+		"b1:u6",
+		"b1:u6/u7/u8",
+		"b2:u1",
+	}, got)
+}
+
+func TestStore_Remove(t *testing.T) {
+	store := newTestStore(t)
+
+	require.NoError(t, store.Remove("b1", paths.NewUnencrypted("u1/u2/u3")))
+
+	_, _, base := store.LookupUnencrypted("b1", paths.NewUnencrypted("u1/u2/u3"))
+	assert.Nil(t, base)
+
+	// removing a whole subtree prunes u2 since it now has no base and no
+	// remaining children, but must leave sibling u5 under u1 intact.
+	_, _, base = store.LookupUnencrypted("b1", paths.NewUnencrypted("u1/u5"))
+	require.NotNil(t, base)
+	assert.Equal(t, "u1/u5", base.Unencrypted.Raw())
+
+	require.NoError(t, store.Remove("b1", paths.NewUnencrypted("u6")))
+
+	_, _, base = store.LookupUnencrypted("b1", paths.NewUnencrypted("u6/u7/u8"))
+	assert.Nil(t, base)
+
+	require.NoError(t, store.Remove("b2", paths.NewUnencrypted("u1")))
+	_, _, base = store.LookupUnencrypted("b2", paths.NewUnencrypted("u1"))
+	assert.Nil(t, base)
+}
+
+func TestStore_MarshalUnmarshalBinary(t *testing.T) {
+	store := newTestStore(t)
+
+	data, err := store.MarshalBinary()
+	require.NoError(t, err)
+
+	restored := NewStore()
+	require.NoError(t, restored.UnmarshalBinary(data))
+
+	var want, got []string
+	require.NoError(t, store.Iterate(func(bucket string, base *Base) error {
+		want = append(want, bucket+":"+base.Unencrypted.Raw()+":"+base.Encrypted.Raw())
+		return nil
+	}))
+	require.NoError(t, restored.Iterate(func(bucket string, base *Base) error {
+		got = append(got, bucket+":"+base.Unencrypted.Raw()+":"+base.Encrypted.Raw())
+		return nil
+	}))
+	assert.Equal(t, want, got)
+
+	_, _, base := restored.LookupUnencrypted("b1", paths.NewUnencrypted("u1/u2/u3"))
+	require.NotNil(t, base)
+	assert.EqualValues(t, 3, base.Key[0])
+
+	_, _, base = restored.LookupUnencrypted("b2", paths.NewUnencrypted("u1"))
+	require.NotNil(t, base)
+	assert.EqualValues(t, 1, base.Key[0])
+}